@@ -0,0 +1,121 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+type accessLogContextKey string
+
+const accessLogEntryContextKey accessLogContextKey = "accessLogEntry"
+
+// accessLogEntry holds the parts of an access log line only the handler knows.
+type accessLogEntry struct {
+	UpstreamURL  string
+	TokenRefresh string
+}
+
+func withAccessLogEntry(ctx context.Context) (context.Context, *accessLogEntry) {
+	entry := &accessLogEntry{}
+	return context.WithValue(ctx, accessLogEntryContextKey, entry), entry
+}
+
+// accessLogEntryFromContext returns the entry stashed on ctx, or a throwaway one.
+func accessLogEntryFromContext(ctx context.Context) *accessLogEntry {
+	entry, _ := ctx.Value(accessLogEntryContextKey).(*accessLogEntry)
+	if entry == nil {
+		return &accessLogEntry{}
+	}
+	return entry
+}
+
+// statusRecorder wraps http.ResponseWriter to capture status code and bytes written.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// accessLogLine is a single structured access log entry.
+type accessLogLine struct {
+	Method       string  `json:"method"`
+	Path         string  `json:"path"`
+	Status       int     `json:"status"`
+	Bytes        int     `json:"bytes"`
+	LatencyMS    float64 `json:"latency_ms"`
+	RemoteIP     string  `json:"remote_ip"`
+	RequestID    string  `json:"request_id"`
+	UpstreamURL  string  `json:"upstream_url,omitempty"`
+	TokenRefresh string  `json:"token_refresh,omitempty"`
+}
+
+// accessLogMiddleware logs one structured line per request.
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		ctx, entry := withAccessLogEntry(r.Context())
+		r = r.WithContext(ctx)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		httpRequestsInFlight.Inc()
+		next.ServeHTTP(rec, r)
+		httpRequestsInFlight.Dec()
+
+		latency := time.Since(start)
+		remoteIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+		recordRequestMetrics(handlerLabel(r.URL.Path), rec.status, latency)
+
+		logAccess(accessLogLine{
+			Method:       r.Method,
+			Path:         r.URL.Path,
+			Status:       rec.status,
+			Bytes:        rec.bytes,
+			LatencyMS:    latency.Seconds() * 1000,
+			RemoteIP:     remoteIP,
+			RequestID:    requestIDFromContext(r.Context()),
+			UpstreamURL:  entry.UpstreamURL,
+			TokenRefresh: entry.TokenRefresh,
+		})
+	})
+}
+
+// logAccess writes a single access log line in the configured --logformat.
+func logAccess(l accessLogLine) {
+	if *logFormat == "json" {
+		b, err := json.Marshal(l)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		log.Println(string(b))
+		return
+	}
+
+	log.Printf("requestID=%v method=%v path=%v status=%v bytes=%v latency_ms=%.2f remote_ip=%v upstream_url=%v token_refresh=%v",
+		l.RequestID, l.Method, l.Path, l.Status, l.Bytes, l.LatencyMS, l.RemoteIP, l.UpstreamURL, l.TokenRefresh)
+}
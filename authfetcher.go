@@ -0,0 +1,282 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+)
+
+const (
+	//Auth modes for --authmode
+	AuthModeBasic string = "basic"
+	AuthModeJWT   string = "private_key_jwt"
+	AuthModeMTLS  string = "tls_client_auth"
+)
+
+var (
+	authMode = flag.String("authmode", AuthModeBasic, "How Tyro authenticates against the token endpoint: \"basic\", \"private_key_jwt\", or \"tls_client_auth\".")
+
+	jwtKey = flag.String("jwtkey", "", "PEM-encoded private key file used to sign client_assertion JWTs. Required for --authmode=private_key_jwt.")
+	jwtKid = flag.String("jwtkid", "", "Key ID (kid) to put in the client_assertion JWT header.")
+	jwtAlg = flag.String("jwtalg", "RS256", "Signing algorithm for the client_assertion JWT: \"RS256\" or \"ES256\".")
+)
+
+// tokenFetcher makes a single attempt to acquire a new token; TokenSource
+// owns retry and backoff.
+type tokenFetcher interface {
+	fetch() (string, time.Time, error)
+}
+
+// newTokenFetcher builds the tokenFetcher selected by --authmode.
+func newTokenFetcher() (tokenFetcher, error) {
+	switch *authMode {
+	case AuthModeJWT:
+		return newJWTAssertionTokenFetcher()
+	case AuthModeMTLS:
+		return newMTLSTokenFetcher()
+	case AuthModeBasic:
+		return &basicAuthTokenFetcher{}, nil
+	default:
+		return nil, fmt.Errorf("unknown --authmode %q", *authMode)
+	}
+}
+
+// tokenRequestURL builds the token endpoint URL from --url.
+func tokenRequestURL() (*url.URL, error) {
+	parsedAPIURL, err := url.Parse(*apiURL)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenURL := parsedAPIURL
+	tokenURL.Path = path.Join(tokenURL.Path, TokenRequestEndpoint)
+
+	return tokenURL, nil
+}
+
+// decodeTokenResponse reads and validates a token endpoint response shared
+// by every auth mode.
+func decodeTokenResponse(resp *http.Response, err error) (string, time.Time, error) {
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", time.Time{}, fmt.Errorf("token endpoint returned status %v", resp.StatusCode)
+	}
+
+	var responseJSON struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&responseJSON); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return responseJSON.AccessToken, time.Now().Add(time.Duration(responseJSON.ExpiresIn) * time.Second), nil
+}
+
+// basicAuthTokenFetcher is the original auth mode: HTTP Basic auth with
+// --key/--secret against a client_credentials grant.
+type basicAuthTokenFetcher struct{}
+
+func (f *basicAuthTokenFetcher) fetch() (string, time.Time, error) {
+	tokenURL, err := tokenRequestURL()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	bodyValues := url.Values{}
+	bodyValues.Set("grant_type", "client_credentials")
+
+	req, err := http.NewRequest("POST", tokenURL.String(), bytes.NewBufferString(bodyValues.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(*clientKey, *clientSecret)
+
+	resp, err := http.DefaultClient.Do(req)
+	return decodeTokenResponse(resp, err)
+}
+
+// jwtAssertionTokenFetcher implements private_key_jwt (RFC 7523): Tyro
+// signs a JWT assertion with --jwtkey and POSTs it as client_assertion.
+type jwtAssertionTokenFetcher struct {
+	signingKey crypto.Signer
+	keyID      string
+	alg        jose.SignatureAlgorithm
+}
+
+// newJWTAssertionTokenFetcher loads --jwtkey and builds a
+// jwtAssertionTokenFetcher that signs assertions with --jwtalg.
+func newJWTAssertionTokenFetcher() (*jwtAssertionTokenFetcher, error) {
+	if *jwtKey == "" {
+		return nil, fmt.Errorf("--jwtkey is required for --authmode=%v", AuthModeJWT)
+	}
+
+	signingKey, err := loadSigningKey(*jwtKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var alg jose.SignatureAlgorithm
+	switch *jwtAlg {
+	case "RS256":
+		alg = jose.RS256
+	case "ES256":
+		alg = jose.ES256
+	default:
+		return nil, fmt.Errorf("unknown --jwtalg %q", *jwtAlg)
+	}
+
+	return &jwtAssertionTokenFetcher{signingKey: signingKey, keyID: *jwtKid, alg: alg}, nil
+}
+
+func (f *jwtAssertionTokenFetcher) fetch() (string, time.Time, error) {
+	now := time.Now()
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: f.alg, Key: f.signingKey},
+		(&jose.SignerOptions{}).WithHeader("kid", f.keyID),
+	)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	assertion, err := jwt.Signed(signer).Claims(&jwt.Claims{
+		Issuer:    *clientKey,
+		Subject:   *clientKey,
+		Audience:  jwt.Audience{*apiURL},
+		ID:        newRequestID(),
+		IssuedAt:  jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(now.Add(5 * time.Minute)),
+	}).CompactSerialize()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	tokenURL, err := tokenRequestURL()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	bodyValues := url.Values{}
+	bodyValues.Set("grant_type", "client_credentials")
+	bodyValues.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	bodyValues.Set("client_assertion", assertion)
+
+	req, err := http.NewRequest("POST", tokenURL.String(), bytes.NewBufferString(bodyValues.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	return decodeTokenResponse(resp, err)
+}
+
+// mtlsTokenFetcher implements tls_client_auth: the token endpoint is called
+// with --certfile/--keyfile presented as a client certificate.
+type mtlsTokenFetcher struct {
+	client *http.Client
+}
+
+// newMTLSTokenFetcher loads --certfile/--keyfile as a client certificate.
+func newMTLSTokenFetcher() (*mtlsTokenFetcher, error) {
+	if *certFile == "" || *keyFile == "" {
+		return nil, fmt.Errorf("--certfile and --keyfile are required for --authmode=%v", AuthModeMTLS)
+	}
+
+	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		},
+	}
+
+	return &mtlsTokenFetcher{client: client}, nil
+}
+
+func (f *mtlsTokenFetcher) fetch() (string, time.Time, error) {
+	tokenURL, err := tokenRequestURL()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	bodyValues := url.Values{}
+	bodyValues.Set("grant_type", "client_credentials")
+	bodyValues.Set("client_id", *clientKey)
+
+	req, err := http.NewRequest("POST", tokenURL.String(), bytes.NewBufferString(bodyValues.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := f.client.Do(req)
+	return decodeTokenResponse(resp, err)
+}
+
+// loadSigningKey reads a PEM-encoded RSA or EC private key from path.
+func loadSigningKey(path string) (crypto.Signer, error) {
+	keyBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %v", path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key in %v: %v", path, err)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type in %v: %T", path, key)
+	}
+}
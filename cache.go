@@ -0,0 +1,158 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"golang.org/x/sync/singleflight"
+	"sync"
+	"time"
+)
+
+const (
+	//The default number of /status/ responses to keep cached
+	DefaultStatusCacheSize int = 1000
+
+	//The default freshness window for a cached /status/ response
+	DefaultStatusCacheTTL time.Duration = 60 * time.Second
+)
+
+var (
+	statusCacheSize = flag.Int("statuscachesize", DefaultStatusCacheSize, "Maximum number of /status/ responses to cache, by bib ID.")
+	statusCacheTTL  = flag.Duration("statuscachettl", DefaultStatusCacheTTL, "How long a cached /status/ response stays fresh.")
+)
+
+// statusCacheInstance is the statusCache running in this process.
+var statusCacheInstance *statusCache
+
+// statusCacheEntry is a cached /status/ response body, its ETag, and when it expires.
+type statusCacheEntry struct {
+	body      []byte
+	etag      string
+	expiresAt time.Time
+}
+
+// statusCacheListEntry is the container/list payload, pairing a bib ID with its entry.
+type statusCacheListEntry struct {
+	bibID string
+	entry statusCacheEntry
+}
+
+// statusCache is an LRU+TTL cache of /status/ responses keyed by bib ID,
+// using singleflight to collapse concurrent misses for the same bib ID.
+type statusCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	order    *list.List //most-recently-used at the front
+
+	group singleflight.Group
+}
+
+// newStatusCache creates a statusCache holding at most capacity entries.
+func newStatusCache(capacity int, ttl time.Duration) *statusCache {
+	return &statusCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns the cached, unexpired entry for bibID, if any.
+func (c *statusCache) get(bibID string) (statusCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[bibID]
+	if !ok {
+		return statusCacheEntry{}, false
+	}
+
+	listEntry := elem.Value.(*statusCacheListEntry)
+	if time.Now().After(listEntry.entry.expiresAt) {
+		c.order.Remove(elem)
+		delete(c.entries, bibID)
+		return statusCacheEntry{}, false
+	}
+
+	c.order.MoveToFront(elem)
+	return listEntry.entry, true
+}
+
+// set stores entry for bibID, evicting the least-recently-used entry if the
+// cache is at capacity.
+func (c *statusCache) set(bibID string, entry statusCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[bibID]; ok {
+		elem.Value.(*statusCacheListEntry).entry = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	elem := c.order.PushFront(&statusCacheListEntry{bibID: bibID, entry: entry})
+	c.entries[bibID] = elem
+
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		if oldest != nil {
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*statusCacheListEntry).bibID)
+		}
+	}
+}
+
+// invalidate removes bibID from the cache, e.g. after a 401 that forced a
+// token refresh.
+func (c *statusCache) invalidate(bibID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[bibID]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, bibID)
+	}
+}
+
+// fetch returns the cached entry for bibID if it's still fresh. Otherwise
+// it calls fetchFunc, collapsing concurrent calls for the same bibID into
+// one upstream call, caches the result, and returns it.
+func (c *statusCache) fetch(bibID string, fetchFunc func() ([]byte, error)) (statusCacheEntry, error) {
+	if entry, ok := c.get(bibID); ok {
+		statusCacheHitsTotal.Inc()
+		return entry, nil
+	}
+
+	statusCacheMissesTotal.Inc()
+
+	result, err, _ := c.group.Do(bibID, func() (interface{}, error) {
+		body, err := fetchFunc()
+		if err != nil {
+			return nil, err
+		}
+
+		entry := statusCacheEntry{body: body, etag: computeETag(body), expiresAt: time.Now().Add(c.ttl)}
+		c.set(bibID, entry)
+		return entry, nil
+	})
+
+	if err != nil {
+		return statusCacheEntry{}, err
+	}
+
+	return result.(statusCacheEntry), nil
+}
+
+// computeETag returns a strong ETag for body.
+func computeETag(body []byte) string {
+	hexDigest := fmt.Sprintf("%x", sha1.Sum(body))
+	return fmt.Sprintf("%q", hexDigest)
+}
@@ -0,0 +1,21 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import "sync/atomic"
+
+// upstreamResponded is set once the Sierra API has responded successfully,
+// for use by /readyz.
+var upstreamResponded int32
+
+// markUpstreamHealthy records a successful Sierra API response.
+func markUpstreamHealthy() {
+	atomic.StoreInt32(&upstreamResponded, 1)
+}
+
+// upstreamHasResponded reports whether the Sierra API has ever responded successfully.
+func upstreamHasResponded() bool {
+	return atomic.LoadInt32(&upstreamResponded) == 1
+}
@@ -10,11 +10,12 @@ like item status.
 package main
 
 import (
-	"bytes"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/cudevmaxwell-vendor/lumberjack.v2"
 	"html/template"
 	"log"
@@ -53,6 +54,14 @@ const (
 	DefaultLogMaxSize      int    = 100
 	DefaultLogMaxBackups   int    = 0
 	DefaultLogMaxAge       int    = 0
+	DefaultLogFormat       string = "text"
+
+	//The default header used to read/set the per-request ID
+	DefaultRequestIDHeader string = "X-Request-ID"
+
+	//Token persistence and refresh
+	DefaultTokenCache       string        = ""
+	DefaultTokenRefreshLead time.Duration = 20 * time.Second
 )
 
 var (
@@ -65,15 +74,25 @@ var (
 	clientSecret = flag.String("secret", "", "Client Secret")
 	headerACAO   = flag.String("acaoheader", DefaultACAOHeader, "Access-Control-Allow-Origin Header for CORS. Multiple origins separated by ;")
 
+	tokenCache       = flag.String("tokencache", DefaultTokenCache, "File to persist the OAuth token to, so restarts don't force re-authentication. Disabled if empty.")
+	tokenRefreshLead = flag.Duration("tokenrefreshlead", DefaultTokenRefreshLead, "How long before token expiry to proactively refresh it.")
+
 	logFileLocation = flag.String("logfile", DefaultLogFileLocation, "Log file. By default, log messages will be printed to Sterr.")
 	logMaxSize      = flag.Int("logmaxsize", DefaultLogMaxSize, "The maximum size of log files before they are rotated, in megabytes.")
 	logMaxBackups   = flag.Int("logmaxbackups", DefaultLogMaxBackups, "The maximum number of old log files to keep.")
 	logMaxAge       = flag.Int("logmaxage", DefaultLogMaxAge, "The maximum number of days to retain old log files, in days.")
+	logFormat       = flag.String("logformat", DefaultLogFormat, "Access log format, either \"json\" or \"text\".")
+
+	requestIDHeader = flag.String("requestidheader", DefaultRequestIDHeader, "Header to read/set the per-request ID on.")
 
 	templates = template.Must(template.ParseGlob("templates/*.html"))
 
 	tokenChan        chan string
 	refreshTokenChan chan bool
+
+	//The lumberjack writer log output was redirected to, if --logfile is set.
+	//Kept around so SIGHUP can reopen it for logrotate compatibility.
+	logWriter *lumberjack.Logger
 )
 
 func init() {
@@ -111,12 +130,13 @@ func main() {
 	overrideUnsetFlagsFromEnvironmentVariables()
 
 	if *logFileLocation != "Stderr" {
-		log.SetOutput(&lumberjack.Logger{
+		logWriter = &lumberjack.Logger{
 			Filename:   *logFileLocation,
 			MaxSize:    *logMaxSize,
 			MaxBackups: *logMaxBackups,
 			MaxAge:     *logMaxAge,
-		})
+		}
+		log.SetOutput(logWriter)
 	}
 
 	logIfVerbose("Starting Tyro")
@@ -128,7 +148,7 @@ func main() {
 
 	if *clientKey == "" {
 		log.Fatal("A client key is required to authenticate against the Sierra API.")
-	} else if *clientSecret == "" {
+	} else if *authMode == AuthModeBasic && *clientSecret == "" {
 		log.Fatal("A client secret is required to authenticate against the Sierra API.")
 	}
 
@@ -142,18 +162,38 @@ func main() {
 		logIfVerbose("Using Private Key File: " + *keyFile)
 	}
 
-	go tokener()
-	refreshTokenChan <- true
+	fetcher, err := newTokenFetcher()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tokenSource := NewTokenSource(*tokenCache, *tokenRefreshLead, fetcher)
+	go tokenSource.Run()
+
+	statusCacheInstance = newStatusCache(*statusCacheSize, *statusCacheTTL)
 
-	if *certFile == "" {
-		log.Fatal(http.ListenAndServe(*address, nil))
+	go serveHTTPSRedirect()
+
+	if *metricsAddress == "" {
+		http.Handle("/metrics", promhttp.Handler())
 	} else {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			log.Fatal(http.ListenAndServe(*metricsAddress, metricsMux))
+		}()
+	}
+
+	handler := requestIDMiddleware(accessLogMiddleware(urlRewriteMiddleware(http.DefaultServeMux)))
+
+	server := &http.Server{Addr: *address, Handler: handler}
+	if *certFile != "" {
 		//Remove SSL 3.0 compatibility for POODLE exploit mitigation
-		config := &tls.Config{MinVersion: tls.VersionTLS10}
-		server := &http.Server{Addr: *address, Handler: nil, TLSConfig: config}
-		log.Fatal(server.ListenAndServeTLS(*certFile, *keyFile))
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS10}
 	}
 
+	serveWithGracefulShutdown(server, *certFile, *keyFile, tokenSource)
+
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
@@ -162,19 +202,16 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+//errTokenExpired signals that the Sierra API rejected our token with a 401.
+var errTokenExpired = errors.New("token expired")
+
 func statusHandler(w http.ResponseWriter, r *http.Request) {
 
 	token := <-tokenChan
 
-	if token == "uninitialized" {
-		http.Error(w, "Token Error, token not yet created.", http.StatusInternalServerError)
-		logIfVerbose("Internal Server Error at /status/ handler, token not yet generated.")
-		return
-	}
-
 	if token == "" {
-		http.Error(w, "Token Error, token creation failed.", http.StatusInternalServerError)
-		logIfVerbose("Internal Server Error at /status/ handler, token creation failed.")
+		http.Error(w, "Token unavailable, try again shortly.", http.StatusServiceUnavailable)
+		logIfVerbose("Service Unavailable at /status/ handler, no valid token available.")
 		return
 	}
 
@@ -186,6 +223,53 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	entry, err := statusCacheInstance.fetch(bibID, func() ([]byte, error) {
+		return fetchItemStatusJSON(r, bibID, token)
+	})
+
+	if err == errTokenExpired {
+		http.Error(w, "Token is out of date, or is refreshing. Try request again.", http.StatusInternalServerError)
+		logIfVerbose("Internal Server Error at /status/ handler, token is out of date.")
+		accessLogEntryFromContext(r.Context()).TokenRefresh = "triggered"
+		statusCacheInstance.invalidate(bibID)
+		refreshTokenChan <- true
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logIfVerbose(err)
+		return
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" && inm == entry.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if *headerACAO == "*" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else if *headerACAO != "" {
+		possibleOrigins := strings.Split(*headerACAO, ";")
+		for _, okOrigin := range possibleOrigins {
+			okOrigin = strings.TrimSpace(okOrigin)
+			if (okOrigin != "") && (okOrigin == r.Header.Get("Origin")) {
+				w.Header().Set("Access-Control-Allow-Origin", okOrigin)
+			}
+		}
+	}
+
+	w.Header().Set("ETag", entry.etag)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(entry.body)
+
+}
+
+// fetchItemStatusJSON queries the Sierra API for bibID's item status and
+// returns the transformed JSON response Tyro serves to clients. It returns
+// errTokenExpired if Sierra rejects token with a 401.
+func fetchItemStatusJSON(r *http.Request, bibID string, token string) ([]byte, error) {
+
 	parsedAPIURL, err := url.Parse(*apiURL)
 	if err != nil {
 		//No recovery possible here, probable problem with URL
@@ -200,6 +284,8 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	q.Set("deleted", "false")
 	itemStatusURL.RawQuery = q.Encode()
 
+	accessLogEntryFromContext(r.Context()).UpstreamURL = itemStatusURL.String()
+
 	getItemStatus, err := http.NewRequest("GET", itemStatusURL.String(), nil)
 	if err != nil {
 		//No recovery possible here, probable problem with URL
@@ -211,17 +297,14 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	client := &http.Client{}
 	resp, err := client.Do(getItemStatus)
 	if err != nil {
-		http.Error(w, "Error querying Sierra API", http.StatusInternalServerError)
-		logIfVerbose("Internal Server Error at /status/ handler, GET against itemStatusURL failed.")
-		logIfVerbose(err)
-		return
+		return nil, fmt.Errorf("error querying Sierra API: %v", err)
 	}
+	defer resp.Body.Close()
+
+	recordUpstreamResponse(resp.StatusCode)
 
 	if resp.StatusCode == 401 {
-		http.Error(w, "Token is out of date, or is refreshing. Try request again.", http.StatusInternalServerError)
-		logIfVerbose("Internal Server Error at /status/ handler, token is out of date.")
-		refreshTokenChan <- true
-		return
+		return nil, errTokenExpired
 	}
 
 	var responseJSON struct {
@@ -236,13 +319,8 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 		} `json:"entries"`
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&responseJSON)
-	defer resp.Body.Close()
-	if err != nil {
-		http.Error(w, "JSON Decoding Error", http.StatusInternalServerError)
-		logIfVerbose("Internal Server Error at /status/ handler, JSON Decoding Error")
-		logIfVerbose(err)
-		return
+	if err := json.NewDecoder(resp.Body).Decode(&responseJSON); err != nil {
+		return nil, fmt.Errorf("JSON decoding error: %v", err)
 	}
 
 	type Entry struct {
@@ -270,39 +348,15 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 		statusJSON.Entries = append(statusJSON.Entries, newEntry)
 	}
 
-	json, err := json.MarshalIndent(statusJSON, "", "   ")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if *headerACAO == "*" {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-	} else if *headerACAO != "" {
-		possibleOrigins := strings.Split(*headerACAO, ";")
-		for _, okOrigin := range possibleOrigins {
-			okOrigin = strings.TrimSpace(okOrigin)
-			if (okOrigin != "") && (okOrigin == r.Header.Get("Origin")) {
-				w.Header().Set("Access-Control-Allow-Origin", okOrigin)
-			}
-		}
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(json)
-
+	return json.MarshalIndent(statusJSON, "", "   ")
 }
 
 func rawRewriter(r *http.Request) {
 
 	token := <-tokenChan
 
-	if token == "uninitialized" {
-		logIfVerbose("Error at /raw/ handler, token not yet generated.")
-	}
-
 	if token == "" {
-		logIfVerbose("Error at /raw/ handler, token creation failed.")
+		logIfVerbose("Error at /raw/ handler, no valid token available.")
 	}
 
 	parsedAPIURL, err := url.Parse(*apiURL)
@@ -315,6 +369,8 @@ func rawRewriter(r *http.Request) {
 	rawRequestURL.Path = path.Join(rawRequestURL.Path, r.URL.Path[len("/raw/"):])
 	rawRequestURL.RawQuery = r.URL.RawQuery
 
+	accessLogEntryFromContext(r.Context()).UpstreamURL = rawRequestURL.String()
+
 	r.URL = rawRequestURL
 
 	setAuthorizationHeaders(r, r, token)
@@ -324,108 +380,6 @@ func rawRewriter(r *http.Request) {
 
 }
 
-func tokener() {
-
-	type AuthTokenResponse struct {
-		AccessToken string `json:"access_token"`
-		TokenType   string `json:"token_type"`
-		ExpiresIn   int    `json:"expires_in"`
-	}
-
-	token := "uninitialized"
-
-	for {
-		select {
-		case <-refreshTokenChan:
-
-			logIfVerbose("Asking for new token...")
-
-			stopIntrim := make(chan bool)
-
-			go func() {
-				logIfVerbose("Serving old token while we wait.")
-				oldToken := token
-			RunForever:
-				for {
-					select {
-					case tokenChan <- oldToken:
-						logIfVerbose("Sent token: " + oldToken)
-					case <-stopIntrim:
-						close(stopIntrim)
-						break RunForever
-					}
-				}
-			}()
-
-			parsedAPIURL, err := url.Parse(*apiURL)
-			if err != nil {
-				//No recovery possible here, probable problem with URL
-				log.Fatal(err)
-			}
-
-			tokenRequestURL := parsedAPIURL
-			tokenRequestURL.Path = path.Join(tokenRequestURL.Path, TokenRequestEndpoint)
-
-			bodyValues := url.Values{}
-			bodyValues.Set("grant_type", "client_credentials")
-
-			getTokenRequest, err := http.NewRequest("POST", tokenRequestURL.String(), bytes.NewBufferString(bodyValues.Encode()))
-			if err != nil {
-				//No recovery possible here, probable problem with URL
-				log.Fatal(err)
-			}
-
-			getTokenRequest.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-			getTokenRequest.SetBasicAuth(*clientKey, *clientSecret)
-
-			client := &http.Client{}
-			resp, err := client.Do(getTokenRequest)
-			if err != nil {
-				token = ""
-				logIfVerbose("Unable to get new token!")
-				logIfVerbose(err)
-				logIfVerbose(resp)
-				return
-			}
-
-			if resp.StatusCode != 200 {
-				token = ""
-				logIfVerbose("Token generation error: Client key, client secret, or API URL might be incorrect.")
-				return
-			}
-
-			var responseJSON AuthTokenResponse
-
-			err = json.NewDecoder(resp.Body).Decode(&responseJSON)
-			defer resp.Body.Close()
-			if err != nil {
-				token = ""
-				logIfVerbose("Unable to parse new token response!")
-				logIfVerbose(err)
-				logIfVerbose(resp)
-				return
-			}
-
-			logIfVerbose(responseJSON)
-
-			stopIntrim <- true
-			<-stopIntrim
-
-			token = responseJSON.AccessToken
-
-			logIfVerbose("Received new token from API.")
-
-			go func() {
-				time.Sleep(time.Duration(responseJSON.ExpiresIn-20) * time.Second)
-				refreshTokenChan <- true
-			}()
-
-		case tokenChan <- token:
-			logIfVerbose("Sent token: " + token)
-		}
-	}
-}
-
 func overrideUnsetFlagsFromEnvironmentVariables() {
 	listOfUnsetFlags := make(map[*flag.Flag]bool)
 
@@ -468,6 +422,10 @@ func setAuthorizationHeaders(nr *http.Request, or *http.Request, t string) {
 	nr.Header.Add("Authorization", "Bearer "+t)
 	nr.Header.Add("User-Agent", "Tyro")
 
+	if requestID := requestIDFromContext(or.Context()); requestID != "" {
+		nr.Header.Set(*requestIDHeader, requestID)
+	}
+
 	originalForwardFor := or.Header.Get("X-Forwarded-For")
 	if originalForwardFor == "" {
 		ip, _, _ := net.SplitHostPort(or.RemoteAddr)
@@ -0,0 +1,121 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//The default address for the /metrics endpoint. Empty serves it on --address.
+const DefaultMetricsAddress string = ""
+
+var metricsAddress = flag.String("metricsaddress", DefaultMetricsAddress, "Optional separate address to serve /metrics on, so it isn't exposed alongside the public API.")
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tyro_http_requests_total",
+		Help: "Total HTTP requests handled, by handler and status code.",
+	}, []string{"handler", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "tyro_http_request_duration_seconds",
+		Help: "HTTP request latency in seconds, by handler.",
+	}, []string{"handler"})
+
+	httpRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tyro_http_requests_in_flight",
+		Help: "Number of HTTP requests currently being served.",
+	})
+
+	upstreamResponsesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tyro_upstream_responses_total",
+		Help: "Sierra API responses received, by status code.",
+	}, []string{"status"})
+
+	tokenRefreshesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tyro_token_refreshes_total",
+		Help: "Token refresh attempts, by outcome (success or failure).",
+	}, []string{"outcome"})
+
+	tokenAgeSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tyro_token_age_seconds",
+		Help: "Age in seconds of the most recently issued token.",
+	})
+
+	statusCacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tyro_status_cache_hits_total",
+		Help: "Number of /status/ requests served from cache.",
+	})
+
+	statusCacheMissesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tyro_status_cache_misses_total",
+		Help: "Number of /status/ requests that missed the cache.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequestsTotal)
+	prometheus.MustRegister(httpRequestDuration)
+	prometheus.MustRegister(httpRequestsInFlight)
+	prometheus.MustRegister(upstreamResponsesTotal)
+	prometheus.MustRegister(tokenRefreshesTotal)
+	prometheus.MustRegister(tokenAgeSeconds)
+	prometheus.MustRegister(statusCacheHitsTotal)
+	prometheus.MustRegister(statusCacheMissesTotal)
+
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+}
+
+// healthzHandler reports process liveness.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// readyzHandler reports readiness: a valid token and an upstream response.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if tokenSourceInstance == nil || !tokenSourceInstance.Ready() || !upstreamHasResponded() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// handlerLabel maps a request path to its metrics handler label.
+func handlerLabel(urlPath string) string {
+	switch {
+	case strings.HasPrefix(urlPath, "/status/"):
+		return "status"
+	case strings.HasPrefix(urlPath, "/raw/"):
+		return "raw"
+	case strings.HasPrefix(urlPath, "/static/"):
+		return "static"
+	case urlPath == "/healthz", urlPath == "/readyz", urlPath == "/metrics":
+		return "internal"
+	default:
+		return "home"
+	}
+}
+
+// recordRequestMetrics records a request's outcome and latency.
+func recordRequestMetrics(handler string, status int, duration time.Duration) {
+	httpRequestsTotal.WithLabelValues(handler, strconv.Itoa(status)).Inc()
+	httpRequestDuration.WithLabelValues(handler).Observe(duration.Seconds())
+}
+
+// recordUpstreamResponse records a Sierra API response and marks it healthy
+// if it was a 2xx success.
+func recordUpstreamResponse(status int) {
+	upstreamResponsesTotal.WithLabelValues(strconv.Itoa(status)).Inc()
+	if status >= 200 && status < 300 {
+		markUpstreamHealthy()
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+const (
+	//Modes for --redirecthttp
+	RedirectHTTPOff       string = "off"
+	RedirectHTTPPermanent string = "permanent"
+	RedirectHTTPTemporary string = "temporary"
+
+	//The default address the plain-HTTP redirect server listens on
+	DefaultRedirectEntrypoint string = ":8080"
+
+	//Modes for --redirectstatus
+	RedirectStatusPermanent string = "permanent"
+	RedirectStatusTemporary string = "temporary"
+)
+
+var (
+	redirectHTTP       = flag.String("redirecthttp", RedirectHTTPOff, "Run a plain-HTTP server that redirects to the HTTPS address: \"permanent\" (301), \"temporary\" (302), or \"off\".")
+	redirectEntrypoint = flag.String("redirectentrypoint", DefaultRedirectEntrypoint, "Address for the plain-HTTP redirect server to bind on.")
+
+	redirectRegex       = flag.String("redirectregex", "", "Regular expression matched against the scheme://host+path+query of the request for arbitrary rewrites (e.g. hostname canonicalization). Used with --redirectreplacement.")
+	redirectReplacement = flag.String("redirectreplacement", "", "Replacement URL for --redirectregex, using Go regexp replacement syntax ($1, $2, ...).")
+	redirectStatus      = flag.String("redirectstatus", RedirectStatusTemporary, "HTTP status for --redirectregex rewrites: \"permanent\" (301) or \"temporary\" (302).")
+)
+
+// redirectStatusCode maps --redirecthttp's "permanent"/"temporary" to the
+// HTTP status codes used for the redirect.
+func redirectStatusCode() int {
+	if *redirectHTTP == RedirectHTTPPermanent {
+		return http.StatusMovedPermanently
+	}
+	return http.StatusFound
+}
+
+// rewriteStatusCode maps --redirectstatus's "permanent"/"temporary" to the
+// HTTP status code used for a --redirectregex rewrite.
+func rewriteStatusCode() int {
+	if *redirectStatus == RedirectStatusPermanent {
+		return http.StatusMovedPermanently
+	}
+	return http.StatusFound
+}
+
+// serveHTTPSRedirect runs a plain-HTTP server on --redirectentrypoint that
+// redirects every request to the HTTPS --address.
+func serveHTTPSRedirect() {
+	if *redirectHTTP == RedirectHTTPOff {
+		return
+	}
+
+	logIfVerbose("Redirecting plain HTTP on " + *redirectEntrypoint + " to HTTPS on " + *address)
+
+	log.Fatal(http.ListenAndServe(*redirectEntrypoint, http.HandlerFunc(httpsRedirectHandler)))
+}
+
+// httpsRedirectHandler redirects a plain-HTTP request to its HTTPS equivalent.
+func httpsRedirectHandler(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+
+	_, httpsPort, err := net.SplitHostPort(*address)
+	if err == nil && httpsPort != "" && httpsPort != "443" {
+		host = host + ":" + httpsPort
+	}
+
+	target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+
+	http.Redirect(w, r, target.String(), redirectStatusCode())
+}
+
+// urlRewriteMiddleware redirects requests matching --redirectregex to
+// --redirectreplacement, passing everything else through unchanged.
+func urlRewriteMiddleware(next http.Handler) http.Handler {
+	if *redirectRegex == "" {
+		return next
+	}
+
+	regex, err := regexp.Compile(*redirectRegex)
+	if err != nil {
+		log.Fatalf("Unable to compile --redirectregex %q: %v", *redirectRegex, err)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestURL := rewriteMatchURL(r)
+
+		if !regex.MatchString(requestURL) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		replaced := regex.ReplaceAllString(requestURL, *redirectReplacement)
+
+		http.Redirect(w, r, replaced, rewriteStatusCode())
+	})
+}
+
+// rewriteMatchURL builds the scheme://host+path+query string --redirectregex
+// is matched against. r.URL alone never carries the scheme or host for a
+// non-proxy request, so those are taken from r.TLS and r.Host instead.
+func rewriteMatchURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	full := url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	return full.String()
+}
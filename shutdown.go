@@ -0,0 +1,86 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+//The default time allowed for in-flight requests to finish during shutdown
+const DefaultShutdownTimeout time.Duration = 15 * time.Second
+
+var shutdownTimeout = flag.Duration("shutdowntimeout", DefaultShutdownTimeout, "How long to wait for in-flight requests to finish during a graceful shutdown.")
+
+// serveWithGracefulShutdown runs server until SIGINT or SIGTERM, draining
+// in-flight requests within --shutdowntimeout before returning. SIGHUP
+// instead reloads configuration without restarting the process.
+func serveWithGracefulShutdown(server *http.Server, certFile, keyFile string, tokenSource *TokenSource) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if certFile == "" {
+			serveErr <- server.ListenAndServe()
+		} else {
+			serveErr <- server.ListenAndServeTLS(certFile, keyFile)
+		}
+	}()
+
+	for {
+		select {
+		case err := <-serveErr:
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+			return
+
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reloadConfig()
+				continue
+			}
+
+			logIfVerbose("Shutting down...")
+
+			ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+			if err := server.Shutdown(ctx); err != nil {
+				log.Println("Error during graceful shutdown:", err)
+			}
+			cancel()
+
+			tokenSource.Stop()
+
+			if logWriter != nil {
+				logWriter.Close()
+			}
+
+			return
+		}
+	}
+}
+
+// reloadConfig re-reads environment variable overrides, reopens the log
+// file, and forces a token refresh.
+func reloadConfig() {
+	logIfVerbose("Reloading configuration on SIGHUP...")
+
+	overrideUnsetFlagsFromEnvironmentVariables()
+
+	if logWriter != nil {
+		if err := logWriter.Rotate(); err != nil {
+			log.Println("Error reopening log file:", err)
+		}
+	}
+
+	refreshTokenChan <- true
+}
@@ -0,0 +1,247 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	minTokenBackoff time.Duration = 1 * time.Second
+	maxTokenBackoff time.Duration = 2 * time.Minute
+)
+
+// cachedToken is the on-disk representation of a persisted OAuth token.
+type cachedToken struct {
+	AccessToken string    `json:"access_token"`
+	Expiry      time.Time `json:"expiry"`
+}
+
+// tokenResult is the outcome of a single token fetch attempt.
+type tokenResult struct {
+	token  string
+	expiry time.Time
+	err    error
+}
+
+// TokenSource serves the current token on tokenChan, refreshing it in the
+// background ahead of expiry and retrying indefinitely on failure.
+type TokenSource struct {
+	token    string
+	expiry   time.Time
+	issuedAt time.Time
+
+	cachePath   string
+	refreshLead time.Duration
+	fetcher     tokenFetcher
+
+	ready int32         //atomic; 1 once a valid, unexpired token is available
+	stop  chan struct{} //closed by Stop to drain Run
+}
+
+// tokenSourceInstance is the TokenSource running in this process, consulted
+// by /readyz.
+var tokenSourceInstance *TokenSource
+
+// NewTokenSource creates a TokenSource that acquires tokens with fetcher,
+// loading a persisted token from cachePath if present.
+func NewTokenSource(cachePath string, refreshLead time.Duration, fetcher tokenFetcher) *TokenSource {
+	ts := &TokenSource{cachePath: cachePath, refreshLead: refreshLead, fetcher: fetcher, stop: make(chan struct{})}
+	ts.load()
+	ts.updateReady()
+	tokenSourceInstance = ts
+	return ts
+}
+
+// Ready reports whether a valid, unexpired token is currently available.
+func (ts *TokenSource) Ready() bool {
+	return atomic.LoadInt32(&ts.ready) == 1
+}
+
+// Stop signals Run to return. It does not wait for Run to exit.
+func (ts *TokenSource) Stop() {
+	close(ts.stop)
+}
+
+// updateReady refreshes the atomic ready flag from the current token state.
+func (ts *TokenSource) updateReady() {
+	if ts.valid() {
+		atomic.StoreInt32(&ts.ready, 1)
+	} else {
+		atomic.StoreInt32(&ts.ready, 0)
+	}
+}
+
+// load reads a previously persisted token from --tokencache, if set and
+// present.
+func (ts *TokenSource) load() {
+	if ts.cachePath == "" {
+		return
+	}
+
+	f, err := os.Open(ts.cachePath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var cached cachedToken
+	if err := json.NewDecoder(f).Decode(&cached); err != nil {
+		logIfVerbose("Unable to parse token cache file, ignoring it.")
+		return
+	}
+
+	ts.token = cached.AccessToken
+	ts.expiry = cached.Expiry
+
+	logIfVerbose("Loaded cached token from " + ts.cachePath)
+}
+
+// save persists the current token and expiry to --tokencache, if set.
+func (ts *TokenSource) save() {
+	if ts.cachePath == "" {
+		return
+	}
+
+	f, err := os.Create(ts.cachePath)
+	if err != nil {
+		logIfVerbose("Unable to write token cache file.")
+		logIfVerbose(err)
+		return
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(cachedToken{AccessToken: ts.token, Expiry: ts.expiry}); err != nil {
+		logIfVerbose("Unable to encode token cache file.")
+		logIfVerbose(err)
+	}
+}
+
+// valid reports whether the current token is non-empty and not yet expired.
+func (ts *TokenSource) valid() bool {
+	return ts.token != "" && time.Now().Before(ts.expiry)
+}
+
+// servable returns the current token if valid, or "" otherwise.
+func (ts *TokenSource) servable() string {
+	if ts.valid() {
+		return ts.token
+	}
+	return ""
+}
+
+// Run serves the current token on tokenChan, refreshing it whenever
+// refreshTokenChan fires or --tokenrefreshlead is reached, retrying failed
+// refreshes forever with exponential backoff and jitter.
+func (ts *TokenSource) Run() {
+	backoff := minTokenBackoff
+	resultChan := make(chan tokenResult)
+	fetching := false
+
+	var retryTimer *time.Timer
+	var retryTimerChan <-chan time.Time
+
+	var leadTimer *time.Timer
+	var leadTimerChan <-chan time.Time
+
+	startFetch := func() {
+		if fetching {
+			return
+		}
+		fetching = true
+		logIfVerbose("Asking for new token...")
+		go func() {
+			token, expiry, err := ts.fetcher.fetch()
+			resultChan <- tokenResult{token: token, expiry: expiry, err: err}
+		}()
+	}
+
+	startFetch()
+
+	for {
+		select {
+		case <-ts.stop:
+			return
+
+		case <-refreshTokenChan:
+			startFetch()
+
+		case <-retryTimerChan:
+			startFetch()
+
+		case <-leadTimerChan:
+			startFetch()
+
+		case result := <-resultChan:
+			fetching = false
+
+			if retryTimer != nil {
+				retryTimer.Stop()
+				retryTimerChan = nil
+			}
+
+			if result.err != nil {
+				logIfVerbose("Unable to get new token, will retry.")
+				logIfVerbose(result.err)
+
+				tokenRefreshesTotal.WithLabelValues("failure").Inc()
+				ts.updateReady()
+
+				retryTimer = time.NewTimer(jitter(backoff))
+				retryTimerChan = retryTimer.C
+				backoff = nextBackoff(backoff)
+				continue
+			}
+
+			backoff = minTokenBackoff
+			ts.token = result.token
+			ts.expiry = result.expiry
+			ts.issuedAt = time.Now()
+			ts.save()
+			ts.updateReady()
+
+			tokenRefreshesTotal.WithLabelValues("success").Inc()
+
+			logIfVerbose("Received new token from API.")
+
+			if leadTimer != nil {
+				leadTimer.Stop()
+			}
+			lead := time.Until(ts.expiry) - ts.refreshLead
+			if lead < 0 {
+				lead = 0
+			}
+			leadTimer = time.NewTimer(lead)
+			leadTimerChan = leadTimer.C
+
+		case tokenChan <- ts.servable():
+			logIfVerbose("Sent token: " + ts.servable())
+			ts.updateReady()
+			if !ts.issuedAt.IsZero() {
+				tokenAgeSeconds.Set(time.Since(ts.issuedAt).Seconds())
+			}
+		}
+	}
+}
+
+// nextBackoff doubles d, capped at maxTokenBackoff.
+func nextBackoff(d time.Duration) time.Duration {
+	next := d * 2
+	if next > maxTokenBackoff {
+		next = maxTokenBackoff
+	}
+	return next
+}
+
+// jitter returns a random duration in [d/2, d], so that repeated retries
+// from multiple Tyro instances don't hammer the token endpoint in lockstep.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half+1)))
+}
@@ -0,0 +1,176 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withTokenFlags points --url/--key/--secret at a test token endpoint for
+// the duration of a test, restoring the previous values afterwards.
+func withTokenFlags(t *testing.T, url, key, secret string) {
+	origURL, origKey, origSecret := *apiURL, *clientKey, *clientSecret
+	*apiURL, *clientKey, *clientSecret = url, key, secret
+	t.Cleanup(func() {
+		*apiURL, *clientKey, *clientSecret = origURL, origKey, origSecret
+	})
+}
+
+func tokenEndpointStub(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestBasicAuthTokenFetcherFetch(t *testing.T) {
+	server := tokenEndpointStub(t, func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "testkey" || pass != "testsecret" {
+			t.Errorf("got Basic auth %q/%q, want \"testkey\"/\"testsecret\"", user, pass)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "abc123",
+			"token_type":   "bearer",
+			"expires_in":   60,
+		})
+	})
+	withTokenFlags(t, server.URL+"/", "testkey", "testsecret")
+
+	token, expiry, err := (&basicAuthTokenFetcher{}).fetch()
+	if err != nil {
+		t.Fatalf("fetch() returned error: %v", err)
+	}
+	if token != "abc123" {
+		t.Errorf("token = %q, want %q", token, "abc123")
+	}
+	if !expiry.After(time.Now()) {
+		t.Errorf("expiry %v is not in the future", expiry)
+	}
+}
+
+func TestBasicAuthTokenFetcherFetchError(t *testing.T) {
+	server := tokenEndpointStub(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	withTokenFlags(t, server.URL+"/", "testkey", "testsecret")
+
+	if _, _, err := (&basicAuthTokenFetcher{}).fetch(); err == nil {
+		t.Fatal("fetch() returned no error for a 500 response")
+	}
+}
+
+// TestTokenSourceRunRetriesAndPersists drives TokenSource.Run against a
+// stub that fails once before succeeding, and checks that the eventual
+// token is both served on tokenChan and persisted to --tokencache.
+func TestTokenSourceRunRetriesAndPersists(t *testing.T) {
+	var calls int32
+	server := tokenEndpointStub(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "retried-token",
+			"expires_in":   60,
+		})
+	})
+	withTokenFlags(t, server.URL+"/", "testkey", "testsecret")
+
+	cachePath := filepath.Join(t.TempDir(), "token.json")
+
+	ts := NewTokenSource(cachePath, DefaultTokenRefreshLead, &basicAuthTokenFetcher{})
+	go ts.Run()
+	defer ts.Stop()
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case token := <-tokenChan:
+			if token == "" {
+				continue
+			}
+			if token != "retried-token" {
+				t.Fatalf("token = %q, want %q", token, "retried-token")
+			}
+		case <-deadline:
+			t.Fatal("timed out waiting for token after a retryable failure")
+		}
+		break
+	}
+
+	data, err := os.ReadFile(cachePath)
+	if err != nil {
+		t.Fatalf("token cache file not written: %v", err)
+	}
+	var cached cachedToken
+	if err := json.Unmarshal(data, &cached); err != nil {
+		t.Fatalf("unable to parse persisted token cache: %v", err)
+	}
+	if cached.AccessToken != "retried-token" {
+		t.Errorf("persisted token = %q, want %q", cached.AccessToken, "retried-token")
+	}
+}
+
+// TestTokenSourceRunProactiveRefresh checks that Run refreshes the token on
+// its own ahead of expiry, without anything arriving on refreshTokenChan.
+func TestTokenSourceRunProactiveRefresh(t *testing.T) {
+	var calls int32
+	server := tokenEndpointStub(t, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("token-%d", n),
+			"expires_in":   1,
+		})
+	})
+	withTokenFlags(t, server.URL+"/", "testkey", "testsecret")
+
+	ts := NewTokenSource("", 900*time.Millisecond, &basicAuthTokenFetcher{})
+	go ts.Run()
+	defer ts.Stop()
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case token := <-tokenChan:
+			if token == "token-2" {
+				return
+			}
+		case <-deadline:
+			t.Fatal("timed out waiting for proactive refresh to serve token-2")
+		}
+	}
+}
+
+// TestTokenSourceLoadIgnoresExpiredCache checks that a stale persisted
+// token isn't served as valid.
+func TestTokenSourceLoadIgnoresExpiredCache(t *testing.T) {
+	cachePath := filepath.Join(t.TempDir(), "token.json")
+	expired := cachedToken{AccessToken: "stale-token", Expiry: time.Now().Add(-time.Minute)}
+
+	f, err := os.Create(cachePath)
+	if err != nil {
+		t.Fatalf("unable to create token cache file: %v", err)
+	}
+	if err := json.NewEncoder(f).Encode(expired); err != nil {
+		t.Fatalf("unable to write token cache file: %v", err)
+	}
+	f.Close()
+
+	ts := NewTokenSource(cachePath, DefaultTokenRefreshLead, nil)
+	if ts.Ready() {
+		t.Error("Ready() = true for an expired cached token")
+	}
+	if ts.servable() != "" {
+		t.Errorf("servable() = %q, want \"\" for an expired cached token", ts.servable())
+	}
+}